@@ -23,47 +23,136 @@ var (
 type funcEntry struct {
 	function TimerCallback
 	context  EventContext
+	heapPos  int // index of this timer's id in funcEntries.order; -1 if not scheduled
 }
 
-type funcEntries []funcEntry
+// funcEntries stores every timer registered for a single flow, indexed by
+// TimerID for O(1) add/lookup, with a small binary min-heap (order) on top
+// of the currently scheduled ones, keyed by context.When. This keeps
+// expire to the timers that actually fired - O(k log n) in the number of
+// fired timers - instead of scanning every registered timer on every
+// event. expire returns the new earliest scheduled time (0 if nothing is
+// left), which is what a FlowTable-level scheduler would need to decide
+// which flows' timers aren't due yet and can be skipped without touching
+// them at all.
+//
+// PARTIAL: that table-level half of the ask - a global heap or timing
+// wheel over every flow's earliest timer, so the table can skip flows
+// that aren't due without touching them - is NOT implemented here. This
+// package has no FlowTable type to add it to; only this per-flow heap
+// exists. Don't treat the request this type closes out as fully done -
+// the bottleneck it was meant to fix (the table still visiting every flow
+// every tick) is still there.
+type funcEntries struct {
+	entry []funcEntry
+	order []TimerID
+}
 
 func makeFuncEntries() funcEntries {
-	return make(funcEntries, 2)
+	entry := make([]funcEntry, 2)
+	entry[0].heapPos = -1
+	entry[1].heapPos = -1
+	return funcEntries{entry: entry}
+}
+
+func (fe *funcEntries) less(i, j TimerID) bool {
+	return fe.entry[i].context.When < fe.entry[j].context.When
+}
+
+func (fe *funcEntries) swap(i, j int) {
+	fe.order[i], fe.order[j] = fe.order[j], fe.order[i]
+	fe.entry[fe.order[i]].heapPos = i
+	fe.entry[fe.order[j]].heapPos = j
+}
+
+func (fe *funcEntries) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !fe.less(fe.order[i], fe.order[parent]) {
+			break
+		}
+		fe.swap(i, parent)
+		i = parent
+	}
+}
+
+func (fe *funcEntries) down(i int) {
+	n := len(fe.order)
+	for {
+		left := 2*i + 1
+		if left >= n {
+			break
+		}
+		smallest := left
+		if right := left + 1; right < n && fe.less(fe.order[right], fe.order[left]) {
+			smallest = right
+		}
+		if !fe.less(fe.order[smallest], fe.order[i]) {
+			break
+		}
+		fe.swap(i, smallest)
+		i = smallest
+	}
+}
+
+// push schedules id's existing entry in the heap. The caller must have set
+// entry[id].context.When already.
+func (fe *funcEntries) push(id TimerID) {
+	fe.entry[id].heapPos = len(fe.order)
+	fe.order = append(fe.order, id)
+	fe.up(len(fe.order) - 1)
+}
+
+// remove unschedules id from the heap, if it is currently scheduled.
+func (fe *funcEntries) remove(id TimerID) {
+	i := fe.entry[id].heapPos
+	if i < 0 {
+		return
+	}
+	last := len(fe.order) - 1
+	fe.swap(i, last)
+	fe.order = fe.order[:last]
+	fe.entry[id].heapPos = -1
+	if i < last {
+		fe.down(i)
+		fe.up(i)
+	}
 }
 
 func (fe *funcEntries) expire(when DateTimeNanoseconds) DateTimeNanoseconds {
-	var next DateTimeNanoseconds
-	fep := *fe
-	for i, v := range fep {
-		if v.context.When != 0 {
-			if v.context.When <= when {
-				fep[i].function(v.context, when)
-				fep[i].context.When = 0
-			} else if next == 0 || v.context.When <= next {
-				next = v.context.When
-			}
+	for len(fe.order) > 0 {
+		id := fe.order[0]
+		entry := &fe.entry[id]
+		if entry.context.When > when {
+			break
 		}
+		fe.remove(id)
+		entry.function(entry.context, when)
+		entry.context.When = 0
+	}
+	if len(fe.order) == 0 {
+		return 0
 	}
-	return next
+	return fe.entry[fe.order[0]].context.When
 }
 
 func (fe *funcEntries) addTimer(id TimerID, f TimerCallback, context EventContext) {
-	fep := *fe
-	if int(id) >= len(fep) {
-		fep = append(fep, make(funcEntries, len(fep)-int(id)+1)...)
-		*fe = fep
+	if int(id) >= len(fe.entry) {
+		grow := make([]funcEntry, int(id)+1-len(fe.entry))
+		for i := range grow {
+			grow[i].heapPos = -1
+		}
+		fe.entry = append(fe.entry, grow...)
 	}
-	fep[id].function = f
-	fep[id].context = context
+	fe.remove(id)
+	fe.entry[id].function = f
+	fe.entry[id].context = context
+	fe.push(id)
 }
 
 func (fe *funcEntries) hasTimer(id TimerID) bool {
-	fep := *fe
-	if int(id) >= len(fep) || id < 0 {
-		return false
-	}
-	if fep[id].context.When == 0 {
+	if int(id) >= len(fe.entry) || id < 0 {
 		return false
 	}
-	return true
+	return fe.entry[id].heapPos >= 0
 }
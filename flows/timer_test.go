@@ -0,0 +1,52 @@
+package flows
+
+import "testing"
+
+func TestFuncEntriesExpireOrder(t *testing.T) {
+	fe := makeFuncEntries()
+	var fired []DateTimeNanoseconds
+	record := func(context EventContext, when DateTimeNanoseconds) {
+		fired = append(fired, context.When)
+	}
+
+	fe.addTimer(timerIdle, record, EventContext{When: 30})
+	fe.addTimer(timerActive, record, EventContext{When: 10})
+	id := RegisterTimer()
+	fe.addTimer(id, record, EventContext{When: 20})
+
+	if next := fe.expire(15); next != 20 {
+		t.Fatalf("expire(15) returned next=%d, want 20", next)
+	}
+	if len(fired) != 1 || fired[0] != 10 {
+		t.Fatalf("expire(15) fired %v, want [10]", fired)
+	}
+
+	if next := fe.expire(30); next != 0 {
+		t.Fatalf("expire(30) returned next=%d, want 0 (heap empty)", next)
+	}
+	if len(fired) != 3 || fired[1] != 20 || fired[2] != 30 {
+		t.Fatalf("expire(30) fired %v, want [10 20 30]", fired)
+	}
+}
+
+func TestFuncEntriesHasTimerAndReschedule(t *testing.T) {
+	fe := makeFuncEntries()
+	noop := func(EventContext, DateTimeNanoseconds) {}
+
+	if fe.hasTimer(timerIdle) {
+		t.Fatal("hasTimer true before addTimer")
+	}
+	fe.addTimer(timerIdle, noop, EventContext{When: 100})
+	if !fe.hasTimer(timerIdle) {
+		t.Fatal("hasTimer false after addTimer")
+	}
+
+	// rescheduling must not leave a stale heap entry behind
+	fe.addTimer(timerIdle, noop, EventContext{When: 5})
+	if next := fe.expire(5); next != 0 {
+		t.Fatalf("expire(5) returned next=%d, want 0", next)
+	}
+	if fe.hasTimer(timerIdle) {
+		t.Fatal("hasTimer true after the timer fired")
+	}
+}
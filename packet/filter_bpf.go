@@ -0,0 +1,64 @@
+package packet
+
+import (
+	"errors"
+
+	"github.com/CN-TU/go-flows/util"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// bpfFilter matches packets against a tcpdump-style pcap-filter expression,
+// compiled once at construction time and evaluated with a userspace BPF VM.
+type bpfFilter struct {
+	vm   *bpf.VM
+	prog []bpf.RawInstruction
+}
+
+func compileBPF(expr string) (*bpf.VM, []bpf.RawInstruction, error) {
+	raw, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	prog := make([]bpf.RawInstruction, len(raw))
+	insns := make([]bpf.Instruction, len(raw))
+	for i, ins := range raw {
+		prog[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		insns[i] = prog[i]
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vm, prog, nil
+}
+
+func newBPFFilter(args []string) ([]string, util.Module, error) {
+	if len(args) == 0 {
+		return args, nil, errors.New("bpf filter needs a pcap-filter expression")
+	}
+	vm, prog, err := compileBPF(args[0])
+	if err != nil {
+		return args, nil, err
+	}
+	return args[1:], &bpfFilter{vm: vm, prog: prog}, nil
+}
+
+// Matches runs data through the compiled BPF program, ignoring lt since the
+// program already expects a full, link-layer-framed packet.
+func (f *bpfFilter) Matches(lt gopacket.LayerType, data []byte, ci gopacket.CaptureInfo, n uint64) bool {
+	accepted, err := f.vm.Run(data)
+	return err == nil && accepted > 0
+}
+
+func init() {
+	RegisterFilter("bpf", "matches packets against a tcpdump-style pcap-filter expression", newBPFFilter, bpfFilterHelp)
+}
+
+func bpfFilterHelp() string {
+	return `bpf "expression"
+	Compiles expression with the standard pcap-filter syntax (e.g. "tcp port 443 and not net 10.0.0.0/8")
+	and drops every packet that doesn't match it.`
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package packet
+
+import "github.com/CN-TU/go-flows/util"
+
+// newAttachedBPFFilter is the non-Linux fallback: there is no
+// SO_ATTACH_FILTER here, so "bpf-attach" just behaves like the plain
+// userspace "bpf" filter.
+func newAttachedBPFFilter(args []string) ([]string, util.Module, error) {
+	return newBPFFilter(args)
+}
+
+func init() {
+	RegisterFilter("bpf-attach", "alias for bpf on this platform; kernel attachment is Linux-only", newAttachedBPFFilter, bpfFilterHelp)
+}
@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package packet
+
+import (
+	"sync/atomic"
+
+	"github.com/CN-TU/go-flows/util"
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+// attachedBPFFilter behaves like the plain "bpf" filter, but additionally
+// attaches the same compiled program to a capture socket via
+// SO_ATTACH_FILTER (see Attach), so the kernel drops non-matching packets
+// before they ever reach userspace. This is classic (cBPF) socket
+// filtering, same as tcpdump's -F, not eBPF/XDP: no program is loaded
+// through bpf(2)/BPF_PROG_LOAD and nothing is attached to an interface.
+//
+// This is the only kernel-prefilter deliverable this tree implements. A
+// real in-kernel eBPF/XDP prefilter - loading a verifier-safe eBPF
+// bytecode program via BPF_PROG_LOAD and attaching it to an interface,
+// rather than a classic-BPF program to a socket - needs an eBPF loader
+// (e.g. github.com/cilium/ebpf) and a compiled program this tree has
+// neither of, and isn't something that follows from renaming or extending
+// attachedBPFFilter. That part of the ask is descoped here rather than
+// claimed; "bpf-attach" below stays registered as what it actually is.
+type attachedBPFFilter struct {
+	*bpfFilter
+	attached bool
+	dropped  uint64
+}
+
+// newAttachedBPFFilter parses the same "expression" argument as "bpf".
+func newAttachedBPFFilter(args []string) ([]string, util.Module, error) {
+	rest, mod, err := newBPFFilter(args)
+	if err != nil {
+		return rest, nil, err
+	}
+	return rest, &attachedBPFFilter{bpfFilter: mod.(*bpfFilter)}, nil
+}
+
+// Attach installs f's program on fd via SO_ATTACH_FILTER, causing the
+// kernel to drop non-matching packets before they are ever delivered to
+// userspace. It is called from newBatchSource for every configured filter
+// that implements it (see filterAttacher).
+func (f *attachedBPFFilter) Attach(fd int) error {
+	raw := make([]unix.SockFilter, len(f.prog))
+	for i, ins := range f.prog {
+		raw[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	sockProg := unix.SockFprog{Len: uint16(len(raw)), Filter: &raw[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &sockProg); err != nil {
+		return err
+	}
+	f.attached = true
+	return nil
+}
+
+// Matches is only consulted for packets the kernel filter didn't already
+// drop, i.e. whenever Attach was never called or failed and evaluation
+// fell back to the userspace VM.
+func (f *attachedBPFFilter) Matches(lt gopacket.LayerType, data []byte, ci gopacket.CaptureInfo, n uint64) bool {
+	if f.attached {
+		return true
+	}
+	ok := f.bpfFilter.Matches(lt, data, ci, n)
+	if !ok {
+		atomic.AddUint64(&f.dropped, 1)
+	}
+	return ok
+}
+
+// Dropped returns the number of packets this filter has rejected in
+// userspace, for exposure through the module stats surface. It stays at 0
+// once the program is attached, since the kernel drops those packets
+// before Matches ever sees them.
+func (f *attachedBPFFilter) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+func init() {
+	RegisterFilter("bpf-attach", "like bpf, but additionally attaches the program to the capture socket via SO_ATTACH_FILTER so the kernel drops non-matching packets", newAttachedBPFFilter, bpfFilterHelp)
+}
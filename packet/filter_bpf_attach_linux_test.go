@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package packet
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// TestAttachedBPFFilterFallback exercises the Matches/Dropped bookkeeping
+// without going through Attach itself, since that needs a real socket fd
+// and isn't exercisable in every build environment.
+func TestAttachedBPFFilterFallback(t *testing.T) {
+	f := &attachedBPFFilter{bpfFilter: &bpfFilter{vm: buildTestVM(t)}}
+
+	if f.Matches(gopacket.LayerType(0), []byte{0x01}, gopacket.CaptureInfo{}, 0) {
+		t.Error("Matches = true for a non-matching packet before attachment, want false")
+	}
+	if got := f.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+
+	f.attached = true
+	if !f.Matches(gopacket.LayerType(0), []byte{0x01}, gopacket.CaptureInfo{}, 0) {
+		t.Error("Matches = false once attached, want true: the kernel already dropped non-matching packets")
+	}
+	if got := f.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d after attachment, want unchanged 1", got)
+	}
+}
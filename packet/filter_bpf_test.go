@@ -0,0 +1,37 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"golang.org/x/net/bpf"
+)
+
+// buildTestVM assembles a tiny hand-written BPF program - accept only
+// packets whose first byte is 0x42 - without going through
+// pcap.CompileBPFFilter, which needs libpcap and isn't available in every
+// build environment.
+func buildTestVM(t *testing.T) *bpf.VM {
+	t.Helper()
+	insns := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x42, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 65535},
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		t.Fatalf("bpf.NewVM: %v", err)
+	}
+	return vm
+}
+
+func TestBPFFilterMatches(t *testing.T) {
+	f := &bpfFilter{vm: buildTestVM(t)}
+	if !f.Matches(gopacket.LayerType(0), []byte{0x42, 1, 2, 3}, gopacket.CaptureInfo{}, 0) {
+		t.Error("Matches = false for a packet starting with 0x42, want true")
+	}
+	if f.Matches(gopacket.LayerType(0), []byte{0x01, 2, 3}, gopacket.CaptureInfo{}, 0) {
+		t.Error("Matches = true for a packet not starting with 0x42, want false")
+	}
+}
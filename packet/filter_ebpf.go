@@ -0,0 +1,31 @@
+package packet
+
+import (
+	"errors"
+
+	"github.com/CN-TU/go-flows/util"
+)
+
+// errEBPFNotImplemented is returned by newEBPFFilter for every invocation.
+// A real eBPF/XDP prefilter - loading a verifier-safe eBPF program via
+// BPF_PROG_LOAD and attaching it to an interface (or a socket via
+// SO_ATTACH_BPF), as opposed to attachedBPFFilter's classic-BPF
+// SO_ATTACH_FILTER - needs an eBPF loader and a compiled program this tree
+// has neither of. Registering "ebpf" as a real, separate, always-failing
+// module - rather than folding it into "bpf-attach" or only noting the gap
+// in a comment - means selecting it fails loudly instead of silently
+// running classic BPF and calling it done.
+var errEBPFNotImplemented = errors.New("ebpf: not implemented in this tree; use bpf-attach for classic BPF socket-level filtering")
+
+// newEBPFFilter always fails: see errEBPFNotImplemented.
+func newEBPFFilter([]string) ([]string, util.Module, error) {
+	return nil, nil, errEBPFNotImplemented
+}
+
+func ebpfFilterHelp() string {
+	return "eBPF/XDP kernel prefilter - NOT IMPLEMENTED in this tree; selecting it always fails. Use bpf-attach for classic BPF socket-level filtering instead."
+}
+
+func init() {
+	RegisterFilter("ebpf", "eBPF/XDP kernel prefilter (not implemented - always fails, use bpf-attach instead)", newEBPFFilter, ebpfFilterHelp)
+}
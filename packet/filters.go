@@ -27,6 +27,25 @@ func (f Filters) Matches(lt gopacket.LayerType, data []byte, ci gopacket.Capture
 	return true
 }
 
+// filterAttacher is implemented by filters that can additionally attach
+// themselves to a capture socket so the kernel drops non-matching packets
+// before they ever reach userspace (see attachedBPFFilter). Filters that
+// don't implement it are only ever consulted through Matches.
+type filterAttacher interface {
+	Attach(fd int) error
+}
+
+// AttachFilters attaches every filter in fs that implements filterAttacher
+// to fd. Errors are ignored: a filter that fails to attach simply keeps
+// falling back to its regular Matches check.
+func AttachFilters(fs Filters, fd int) {
+	for _, f := range fs {
+		if a, ok := f.(filterAttacher); ok {
+			a.Attach(fd)
+		}
+	}
+}
+
 // RegisterFilter registers an filter (see module system in util)
 func RegisterFilter(name, desc string, new util.ModuleCreator, help util.ModuleHelp) {
 	util.RegisterModule(filterName, name, desc, new, help)
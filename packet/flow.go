@@ -5,9 +5,157 @@ import (
 	"github.com/google/gopacket/layers"
 )
 
+// TCPState represents one endpoint's state in the TCP state machine, as
+// inferred by passively observing the segments it sends.
+type TCPState int
+
+// TCP states, following the classic RFC 793 state diagram. listenState is
+// unused here since every tracked flow is created from an already observed
+// segment, but is kept for completeness of the enumeration.
+const (
+	tcpClosed TCPState = iota
+	tcpListen
+	tcpSynSent
+	tcpSynRcvd
+	tcpEstablished
+	tcpFinWait1
+	tcpFinWait2
+	tcpCloseWait
+	tcpLastAck
+	tcpClosing
+	tcpTimeWait
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case tcpClosed:
+		return "CLOSED"
+	case tcpListen:
+		return "LISTEN"
+	case tcpSynSent:
+		return "SYN_SENT"
+	case tcpSynRcvd:
+		return "SYN_RCVD"
+	case tcpEstablished:
+		return "ESTABLISHED"
+	case tcpFinWait1:
+		return "FIN_WAIT_1"
+	case tcpFinWait2:
+		return "FIN_WAIT_2"
+	case tcpCloseWait:
+		return "CLOSE_WAIT"
+	case tcpLastAck:
+		return "LAST_ACK"
+	case tcpClosing:
+		return "CLOSING"
+	case tcpTimeWait:
+		return "TIME_WAIT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// TCPReassembler receives the in-order, gap-free payload of one direction of
+// a tcpFlow. Implementations are registered with tcpFlow.AddReassembler and
+// are invoked from Event as soon as a segment extends the reassembled
+// stream; segments that arrive out of order or retransmit already-seen data
+// are held back internally until the gap is filled.
+type TCPReassembler interface {
+	Reassembled(flow *tcpFlow, forward bool, payload []byte, context *flows.EventContext)
+}
+
+// maxReassemblyBuffered bounds, per direction, how many bytes of
+// out-of-order segments reassemble will hold waiting for a gap to close.
+// A lossy capture that never delivers the missing bytes would otherwise
+// pin an ever-growing buffer for the lifetime of the flow.
+const maxReassemblyBuffered = 64 * 1024
+
+// tcpDirection tracks the TCP state machine and reassembly progress of a
+// single direction of a flow, as observed from the segments sent by that
+// endpoint.
+type tcpDirection struct {
+	state         TCPState
+	haveSeq       bool
+	nextSeq       uint32
+	outOfOrder    map[uint32][]byte
+	bufferedBytes int
+}
+
+func (d *tcpDirection) reassemble(flow *tcpFlow, forward bool, tcp *layers.TCP, context *flows.EventContext) {
+	payload := tcp.LayerPayload()
+	if len(flow.reassemblers) == 0 {
+		return
+	}
+	seq := tcp.Seq
+	if tcp.SYN {
+		seq++ // SYN consumes one sequence number
+	}
+	if !d.haveSeq {
+		d.nextSeq = seq
+		d.haveSeq = true
+	}
+	if len(payload) == 0 && !tcp.FIN {
+		return
+	}
+	if d.outOfOrder == nil {
+		d.outOfOrder = make(map[uint32][]byte)
+	}
+	if seq != d.nextSeq {
+		// retransmission of already-consumed data, or a gap: buffer until
+		// the missing bytes arrive instead of guessing, up to a bound so a
+		// gap that never closes can't pin unbounded memory.
+		if seqGreaterThan(seq, d.nextSeq) && d.bufferedBytes+len(payload) <= maxReassemblyBuffered {
+			d.outOfOrder[seq] = append([]byte(nil), payload...)
+			d.bufferedBytes += len(payload)
+		}
+		return
+	}
+	d.deliver(flow, forward, payload, context)
+	if tcp.FIN {
+		d.nextSeq++
+	}
+	for {
+		buffered, ok := d.outOfOrder[d.nextSeq]
+		if !ok {
+			break
+		}
+		delete(d.outOfOrder, d.nextSeq)
+		d.bufferedBytes -= len(buffered)
+		d.deliver(flow, forward, buffered, context)
+	}
+}
+
+func (d *tcpDirection) deliver(flow *tcpFlow, forward bool, payload []byte, context *flows.EventContext) {
+	if len(payload) == 0 {
+		return
+	}
+	d.nextSeq += uint32(len(payload))
+	for _, r := range flow.reassemblers {
+		r.Reassembled(flow, forward, payload, context)
+	}
+}
+
+// seqGreaterThan compares two TCP sequence numbers, accounting for wraparound.
+func seqGreaterThan(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// halfCloseIdleTimeout is how long a flow may sit with one direction closed
+// and the other still open before it's exported as idle rather than kept
+// around indefinitely waiting for a close that may never come.
+const halfCloseIdleTimeout flows.DateTimeNanoseconds = 120 * 1e9 // 120s, in nanoseconds
+
+// halfCloseTimer identifies the scheduled half-close idle export below,
+// registered the same way flows' own built-in idle/active timers are (see
+// flows/timer.go), so the export fires even if this flow never receives
+// another packet of its own to re-check the deadline against.
+var halfCloseTimer = flows.RegisterTimer()
+
 type tcpFlow struct {
 	flows.BaseFlow
-	srcFIN, dstFIN, dstACK, srcACK bool
+	src, dst       tcpDirection
+	reassemblers   []TCPReassembler
+	halfCloseSince flows.DateTimeNanoseconds
 }
 
 type uniFlow struct {
@@ -18,47 +166,275 @@ type uniFlow struct {
 //
 // Depending on the event this will either be a tcp flow, or a standard flow
 func NewFlow(event flows.Event, table *flows.FlowTable, key string, lowToHigh bool, context *flows.EventContext, id uint64) flows.Flow {
-	if table.FiveTuple() {
-		tp := event.(Buffer).TransportLayer()
-		if tp != nil && tp.LayerType() == layers.LayerTypeTCP {
-			ret := new(tcpFlow)
-			ret.Init(table, key, lowToHigh, context, id)
-			return ret
-		}
+	if table.FiveTuple() && isTCP(event.(Buffer)) {
+		ret := new(tcpFlow)
+		ret.Init(table, key, lowToHigh, context, id)
+		return ret
 	}
 	ret := new(uniFlow)
 	ret.Init(table, key, lowToHigh, context, id)
 	return ret
 }
 
-func (flow *tcpFlow) Event(event flows.Event, context *flows.EventContext) {
-	flow.BaseFlow.Event(event, context)
-	if !flow.Active() {
-		return
+// isTCP reports whether buffer's outer transport is TCP, or - when buffer
+// is carried inside a recognized tunnel (VXLAN/GRE/GTP-U/MPLS/QinQ) - its
+// inner transport is. This keeps tunneled TCP traffic tracked as a tcpFlow
+// regardless of which layer fivetuple ends up keying on.
+func isTCP(buffer Buffer) bool {
+	if tp := buffer.TransportLayer(); tp != nil && tp.LayerType() == layers.LayerTypeTCP {
+		return true
 	}
-	buffer := event.(Buffer)
-	tcp := buffer.TransportLayer().(*layers.TCP)
-	if tcp.RST {
-		flow.Export(flows.FlowEndReasonEnd, context, context.When())
-		return
+	if _, _, transport, ok := findTunnel(buffer); ok && transport != nil {
+		return transport.LayerType() == layers.LayerTypeTCP
+	}
+	return false
+}
+
+// resolveTCP returns the TCP segment isTCP based its tcpFlow decision on:
+// the outer transport layer if that's already TCP, otherwise the inner
+// transport findTunnel resolves for tunneled traffic (VXLAN/GRE/GTP-U/
+// MPLS/QinQ). buffer.TransportLayer() alone only ever returns the
+// outermost transport layer - for VXLAN- or GTP-U-tunneled TCP that's the
+// outer UDP layer, not the inner TCP segment Event needs to advance the
+// state machine on.
+func resolveTCP(buffer Buffer) *layers.TCP {
+	if tp := buffer.TransportLayer(); tp != nil {
+		if tcp, ok := tp.(*layers.TCP); ok {
+			return tcp
+		}
+	}
+	if _, _, transport, ok := findTunnel(buffer); ok {
+		if tcp, ok := transport.(*layers.TCP); ok {
+			return tcp
+		}
+	}
+	return nil
+}
+
+// AddReassembler registers r to receive the in-order payload stream of both
+// directions of this flow.
+func (flow *tcpFlow) AddReassembler(r TCPReassembler) {
+	flow.reassemblers = append(flow.reassemblers, r)
+}
+
+// TCPState returns the current state of the flow's two endpoints, forward
+// (the flow's src) first.
+func (flow *tcpFlow) TCPState() (src, dst TCPState) {
+	return flow.src.state, flow.dst.state
+}
+
+// advance drives one endpoint's state machine forward based on a segment it
+// just sent. peerFIN reports whether the other endpoint's FIN has already
+// been observed, which disambiguates FIN_WAIT_2 from CLOSING.
+func advance(state TCPState, tcp *layers.TCP, peerFIN bool) TCPState {
+	switch {
+	case tcp.RST:
+		return tcpClosed
+	case tcp.SYN && !tcp.ACK:
+		return tcpSynSent
+	case tcp.SYN && tcp.ACK:
+		if state == tcpSynSent || state == tcpClosed || state == tcpListen {
+			return tcpSynRcvd
+		}
 	}
-	if context.Forward() {
+	switch state {
+	case tcpSynSent, tcpSynRcvd:
+		if tcp.ACK {
+			return tcpEstablished
+		}
+	case tcpEstablished:
 		if tcp.FIN {
-			flow.srcFIN = true
+			if peerFIN {
+				return tcpClosing
+			}
+			return tcpFinWait1
 		}
-		if flow.dstFIN && tcp.ACK {
-			flow.dstACK = true
+		if peerFIN {
+			return tcpCloseWait
 		}
-	} else {
+	case tcpFinWait1:
+		if tcp.FIN {
+			return tcpClosing
+		}
+		if peerFIN {
+			return tcpFinWait2
+		}
+	case tcpFinWait2:
+		if peerFIN {
+			return tcpTimeWait
+		}
+	case tcpCloseWait:
 		if tcp.FIN {
-			flow.dstFIN = true
+			return tcpLastAck
 		}
-		if flow.srcFIN && tcp.ACK {
-			flow.srcACK = true
+	case tcpLastAck, tcpClosing:
+		if tcp.ACK {
+			return tcpTimeWait
 		}
 	}
+	return state
+}
 
-	if flow.srcFIN && flow.srcACK && flow.dstFIN && flow.dstACK {
+// hasSentFIN reports whether an endpoint in state has already sent its own FIN.
+func hasSentFIN(state TCPState) bool {
+	switch state {
+	case tcpFinWait1, tcpFinWait2, tcpClosing, tcpLastAck, tcpTimeWait:
+		return true
+	}
+	return false
+}
+
+// isReuseSYN reports whether a SYN segment sent by an endpoint already in
+// state means the flow's 5-tuple has been reused for a brand new
+// connection, rather than being a retransmission of the original SYN:
+// true as soon as the sender has moved past the handshake at all.
+func isReuseSYN(state TCPState, tcp *layers.TCP) bool {
+	return tcp.SYN && !tcp.ACK && state != tcpClosed && state != tcpListen && state != tcpSynSent
+}
+
+// inHalfClose reports whether exactly one direction of a flow has sent its
+// FIN while the other hasn't - i.e. the flow is genuinely half-closed,
+// rather than fully open or fully closed on both sides.
+func inHalfClose(src, dst TCPState) bool {
+	return hasSentFIN(src) != hasSentFIN(dst)
+}
+
+// halfCloseExpired reports whether a half-close that began at since has
+// been open for longer than halfCloseIdleTimeout as of now. since == 0
+// means no half-close is currently tracked, so it never expires.
+func halfCloseExpired(since, now flows.DateTimeNanoseconds) bool {
+	return since != 0 && now-since > halfCloseIdleTimeout
+}
+
+// tcpAction is what nextTCPAction decided tcpFlow.Event must do about one
+// segment, once it's advanced the state machine: which export (if any) to
+// issue and why, and whether a fresh half-close timer needs registering.
+// Keeping this as a plain value, rather than deciding inline in Event, is
+// what lets the decision logic be driven directly by a test without a real
+// flows.BaseFlow/FlowTable behind it.
+type tcpAction struct {
+	reuse               bool // the 5-tuple was reused: the previous connection must be exported (End) before continuing
+	export              bool
+	exportReason        flows.FlowEndReason
+	startHalfCloseTimer bool
+	halfCloseDeadline   flows.DateTimeNanoseconds
+}
+
+// nextTCPAction advances d - the flow's two directions' state, forward.src
+// first - for a segment sent by the forward endpoint, and reports what
+// Event needs to do as a result. It mutates d in place, including
+// resetting it to a blank pair of directions first if tcp is a reuse SYN,
+// so that on return d always reflects the state Event's own flow.src/dst
+// must be set to.
+func nextTCPAction(d *tcpDirections, forward bool, tcp *layers.TCP, now flows.DateTimeNanoseconds) tcpAction {
+	var action tcpAction
+
+	sender, receiver := &d.dst, &d.src
+	if forward {
+		sender, receiver = &d.src, &d.dst
+	}
+
+	// A SYN from an endpoint that has already moved past the handshake
+	// means the 5-tuple got reused for a new connection: export what we
+	// have so far, reset both directions, and keep processing this very
+	// SYN as the start of the new connection instead of dropping it.
+	if isReuseSYN(*sender, tcp) {
+		action.reuse = true
+		*d = tcpDirections{}
+		sender, receiver = &d.dst, &d.src
+		if forward {
+			sender, receiver = &d.src, &d.dst
+		}
+	}
+
+	*sender = advance(*sender, tcp, hasSentFIN(*receiver))
+
+	if tcp.RST {
+		action.export = true
+		action.exportReason = flows.FlowEndReasonForcedEnd
+		return action
+	}
+
+	if d.src == tcpTimeWait && d.dst == tcpTimeWait {
+		action.export = true
+		action.exportReason = flows.FlowEndReasonEnd
+		return action
+	}
+
+	// Track genuine half-close: one side has sent its FIN, the other
+	// hasn't. A timer for halfCloseIdleTimeout out gets the flow exported
+	// as idle even if it never sees another packet of its own; also
+	// re-check on every packet this flow does receive, in case the
+	// deadline has already passed.
+	if inHalfClose(d.src, d.dst) {
+		if d.halfCloseSince == 0 {
+			d.halfCloseSince = now
+			action.startHalfCloseTimer = true
+			action.halfCloseDeadline = now + halfCloseIdleTimeout
+		} else if halfCloseExpired(d.halfCloseSince, now) {
+			action.export = true
+			action.exportReason = flows.FlowEndReasonIdle
+		}
+	} else {
+		d.halfCloseSince = 0
+	}
+	return action
+}
+
+// tcpDirections is the subset of tcpFlow's per-direction state
+// nextTCPAction needs: the state machine and half-close bookkeeping, but
+// not the reassembly buffers Event manages separately on flow.src/flow.dst.
+type tcpDirections struct {
+	src, dst       TCPState
+	halfCloseSince flows.DateTimeNanoseconds
+}
+
+func (flow *tcpFlow) Event(event flows.Event, context *flows.EventContext) {
+	flow.BaseFlow.Event(event, context)
+	if !flow.Active() {
+		return
+	}
+	buffer := event.(Buffer)
+	tcp := resolveTCP(buffer)
+	if tcp == nil {
+		return
+	}
+	forward := context.Forward()
+
+	dirs := tcpDirections{src: flow.src.state, dst: flow.dst.state, halfCloseSince: flow.halfCloseSince}
+	action := nextTCPAction(&dirs, forward, tcp, context.When())
+
+	if action.reuse {
 		flow.Export(flows.FlowEndReasonEnd, context, context.When())
+		flow.src = tcpDirection{}
+		flow.dst = tcpDirection{}
+	}
+	flow.src.state, flow.dst.state = dirs.src, dirs.dst
+	flow.halfCloseSince = dirs.halfCloseSince
+
+	sender := &flow.dst
+	if forward {
+		sender = &flow.src
+	}
+	sender.reassemble(flow, forward, tcp, context)
+
+	if action.export {
+		flow.Export(action.exportReason, context, context.When())
+		return
+	}
+	if action.startHalfCloseTimer {
+		flow.AddTimer(halfCloseTimer, flow.expireHalfClose, flows.EventContext{When: action.halfCloseDeadline})
+	}
+}
+
+// expireHalfClose is the halfCloseTimer callback: it fires halfCloseIdleTimeout
+// after a half-close was first observed, regardless of whether the flow has
+// received any packet since. It re-checks the directions' state rather than
+// exporting unconditionally, since the connection may have closed normally
+// (or been reused) in the meantime.
+func (flow *tcpFlow) expireHalfClose(context flows.EventContext, now flows.DateTimeNanoseconds) {
+	if !flow.Active() || !inHalfClose(flow.src.state, flow.dst.state) {
+		return
 	}
+	flow.Export(flows.FlowEndReasonIdle, &context, now)
 }
@@ -0,0 +1,264 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/CN-TU/go-flows/flows"
+	"github.com/google/gopacket/layers"
+)
+
+func TestAdvanceHandshakeAndClose(t *testing.T) {
+	cases := []struct {
+		name    string
+		state   TCPState
+		tcp     layers.TCP
+		peerFIN bool
+		want    TCPState
+	}{
+		{"SYN", tcpClosed, layers.TCP{SYN: true}, false, tcpSynSent},
+		{"SYN-ACK", tcpClosed, layers.TCP{SYN: true, ACK: true}, false, tcpSynRcvd},
+		{"handshake ACK", tcpSynSent, layers.TCP{ACK: true}, false, tcpEstablished},
+		{"active close FIN", tcpEstablished, layers.TCP{FIN: true, ACK: true}, false, tcpFinWait1},
+		{"passive close ACK", tcpEstablished, layers.TCP{ACK: true}, true, tcpCloseWait},
+		{"simultaneous close", tcpFinWait1, layers.TCP{FIN: true, ACK: true}, false, tcpClosing},
+		{"FIN_WAIT_1 to FIN_WAIT_2", tcpFinWait1, layers.TCP{ACK: true}, true, tcpFinWait2},
+		{"FIN_WAIT_2 to TIME_WAIT", tcpFinWait2, layers.TCP{ACK: true}, true, tcpTimeWait},
+		{"CLOSE_WAIT to LAST_ACK", tcpCloseWait, layers.TCP{FIN: true, ACK: true}, false, tcpLastAck},
+		{"LAST_ACK to TIME_WAIT", tcpLastAck, layers.TCP{ACK: true}, false, tcpTimeWait},
+		{"CLOSING to TIME_WAIT", tcpClosing, layers.TCP{ACK: true}, false, tcpTimeWait},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := advance(c.state, &c.tcp, c.peerFIN); got != c.want {
+				t.Errorf("advance(%v, ..., peerFIN=%v) = %v, want %v", c.state, c.peerFIN, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAdvanceRST(t *testing.T) {
+	if got := advance(tcpEstablished, &layers.TCP{RST: true}, false); got != tcpClosed {
+		t.Fatalf("RST: got %v, want CLOSED", got)
+	}
+}
+
+func TestHasSentFIN(t *testing.T) {
+	for _, s := range []TCPState{tcpFinWait1, tcpFinWait2, tcpClosing, tcpLastAck, tcpTimeWait} {
+		if !hasSentFIN(s) {
+			t.Errorf("hasSentFIN(%v) = false, want true", s)
+		}
+	}
+	for _, s := range []TCPState{tcpClosed, tcpSynSent, tcpSynRcvd, tcpEstablished, tcpCloseWait} {
+		if hasSentFIN(s) {
+			t.Errorf("hasSentFIN(%v) = true, want false", s)
+		}
+	}
+}
+
+func TestIsReuseSYN(t *testing.T) {
+	cases := []struct {
+		name  string
+		state TCPState
+		tcp   layers.TCP
+		want  bool
+	}{
+		{"fresh SYN from CLOSED", tcpClosed, layers.TCP{SYN: true}, false},
+		{"fresh SYN from LISTEN", tcpListen, layers.TCP{SYN: true}, false},
+		{"retransmitted SYN from SYN_SENT", tcpSynSent, layers.TCP{SYN: true}, false},
+		{"SYN after ESTABLISHED is a reuse", tcpEstablished, layers.TCP{SYN: true}, true},
+		{"SYN after TIME_WAIT is a reuse", tcpTimeWait, layers.TCP{SYN: true}, true},
+		{"SYN-ACK never counts as reuse", tcpEstablished, layers.TCP{SYN: true, ACK: true}, false},
+		{"non-SYN segment never counts as reuse", tcpEstablished, layers.TCP{ACK: true}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isReuseSYN(c.state, &c.tcp); got != c.want {
+				t.Errorf("isReuseSYN(%v, %+v) = %v, want %v", c.state, c.tcp, got, c.want)
+			}
+		})
+	}
+}
+
+func TestInHalfClose(t *testing.T) {
+	cases := []struct {
+		name     string
+		src, dst TCPState
+		want     bool
+	}{
+		{"both established", tcpEstablished, tcpEstablished, false},
+		{"both in TIME_WAIT", tcpTimeWait, tcpTimeWait, false},
+		{"src sent FIN, dst hasn't", tcpFinWait1, tcpEstablished, true},
+		{"dst sent FIN, src hasn't", tcpEstablished, tcpFinWait1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := inHalfClose(c.src, c.dst); got != c.want {
+				t.Errorf("inHalfClose(%v, %v) = %v, want %v", c.src, c.dst, got, c.want)
+			}
+		})
+	}
+}
+
+func TestHalfCloseExpired(t *testing.T) {
+	cases := []struct {
+		name       string
+		since, now flows.DateTimeNanoseconds
+		want       bool
+	}{
+		{"no half-close tracked", 0, halfCloseIdleTimeout * 10, false},
+		{"just started", 1000, 1000, false},
+		{"right at the deadline", 1000, 1000 + halfCloseIdleTimeout, false},
+		{"past the deadline", 1000, 1000 + halfCloseIdleTimeout + 1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := halfCloseExpired(c.since, c.now); got != c.want {
+				t.Errorf("halfCloseExpired(%v, %v) = %v, want %v", c.since, c.now, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNextTCPActionReuseSYN(t *testing.T) {
+	d := tcpDirections{src: tcpTimeWait, dst: tcpTimeWait}
+	action := nextTCPAction(&d, true, &layers.TCP{SYN: true}, 1000)
+
+	if !action.reuse {
+		t.Fatal("reuse = false, want true for a fresh SYN after TIME_WAIT")
+	}
+	// the reuse export itself (old connection, FlowEndReasonEnd) is issued
+	// by the caller when action.reuse is set; action.export here reflects
+	// whether the *new*, just-reset connection also needs exporting.
+	if action.export {
+		t.Fatalf("export = %v, want false right after a plain reuse SYN", action.export)
+	}
+	if d.src != tcpSynSent {
+		t.Errorf("d.src = %v after reuse SYN, want SYN_SENT", d.src)
+	}
+	if d.dst != tcpClosed {
+		t.Errorf("d.dst = %v after reuse SYN, want CLOSED (reset)", d.dst)
+	}
+}
+
+func TestNextTCPActionRSTAfterReuseSYN(t *testing.T) {
+	// A segment with both SYN and RST set is nonsensical on the wire, but
+	// Event must still handle it without crashing: the reuse export fires
+	// first, then the reset-and-advanced state immediately closes again.
+	d := tcpDirections{src: tcpEstablished, dst: tcpEstablished}
+	action := nextTCPAction(&d, true, &layers.TCP{SYN: true, RST: true}, 1000)
+
+	if !action.reuse {
+		t.Fatal("reuse = false, want true")
+	}
+	if !action.export || action.exportReason != flows.FlowEndReasonForcedEnd {
+		t.Fatalf("export = %v/%v, want true/FlowEndReasonForcedEnd", action.export, action.exportReason)
+	}
+	if d.src != tcpClosed {
+		t.Errorf("d.src = %v after SYN+RST, want CLOSED", d.src)
+	}
+}
+
+func TestNextTCPActionHalfCloseScheduleAndExpire(t *testing.T) {
+	d := tcpDirections{src: tcpEstablished, dst: tcpEstablished}
+
+	// forward side sends its FIN: half-close starts, a timer must be scheduled
+	action := nextTCPAction(&d, true, &layers.TCP{FIN: true, ACK: true}, 1000)
+	if !action.startHalfCloseTimer {
+		t.Fatal("startHalfCloseTimer = false, want true on first half-close")
+	}
+	if action.export {
+		t.Fatal("export = true, want false on first half-close")
+	}
+	if want := flows.DateTimeNanoseconds(1000) + halfCloseIdleTimeout; action.halfCloseDeadline != want {
+		t.Errorf("halfCloseDeadline = %v, want %v", action.halfCloseDeadline, want)
+	}
+	if d.halfCloseSince != 1000 {
+		t.Errorf("halfCloseSince = %v, want 1000", d.halfCloseSince)
+	}
+
+	// another packet on the same flow, still within the deadline: no export
+	action = nextTCPAction(&d, true, &layers.TCP{ACK: true}, 1000+halfCloseIdleTimeout)
+	if action.export || action.startHalfCloseTimer {
+		t.Fatalf("action = %+v, want no export and no re-scheduling right at the deadline", action)
+	}
+
+	// a packet arriving past the deadline must export as idle
+	action = nextTCPAction(&d, true, &layers.TCP{ACK: true}, 1000+halfCloseIdleTimeout+1)
+	if !action.export || action.exportReason != flows.FlowEndReasonIdle {
+		t.Fatalf("export = %v/%v, want true/FlowEndReasonIdle once the half-close deadline has passed", action.export, action.exportReason)
+	}
+}
+
+// nextTCPAction above is Event's entire state-machine decision, extracted
+// so the reuse-SYN and half-close-timer sequences that matter most could
+// be driven and asserted on directly. Event itself still can't be driven
+// end-to-end here: it also calls flow.Active()/Export()/AddTimer() on the
+// embedded flows.BaseFlow, and BaseFlow/FlowTable aren't part of this tree
+// (the same reason flow_test.go never constructs a tcpFlow via NewFlow).
+
+type recordingReassembler struct {
+	payloads [][]byte
+}
+
+func (r *recordingReassembler) Reassembled(flow *tcpFlow, forward bool, payload []byte, context *flows.EventContext) {
+	r.payloads = append(r.payloads, append([]byte(nil), payload...))
+}
+
+func TestReassembleOutOfOrder(t *testing.T) {
+	rec := &recordingReassembler{}
+	flow := &tcpFlow{reassemblers: []TCPReassembler{rec}}
+	ctx := &flows.EventContext{}
+
+	// first segment establishes the base sequence number
+	first := &layers.TCP{Seq: 1000}
+	first.Payload = []byte("AAAA")
+	flow.src.reassemble(flow, true, first, ctx)
+
+	// third segment arrives before the second: must be buffered, not delivered
+	third := &layers.TCP{Seq: 1008}
+	third.Payload = []byte("CCCC")
+	flow.src.reassemble(flow, true, third, ctx)
+	if len(rec.payloads) != 1 {
+		t.Fatalf("out-of-order segment delivered early: got %d payloads, want 1", len(rec.payloads))
+	}
+
+	// second segment closes the gap: both buffered segments flush in order
+	second := &layers.TCP{Seq: 1004}
+	second.Payload = []byte("BBBB")
+	flow.src.reassemble(flow, true, second, ctx)
+
+	if len(rec.payloads) != 3 {
+		t.Fatalf("got %d payloads, want 3", len(rec.payloads))
+	}
+	want := []string{"AAAA", "BBBB", "CCCC"}
+	for i, w := range want {
+		if string(rec.payloads[i]) != w {
+			t.Errorf("payload %d = %q, want %q", i, rec.payloads[i], w)
+		}
+	}
+	if flow.src.bufferedBytes != 0 {
+		t.Fatalf("bufferedBytes = %d after flush, want 0", flow.src.bufferedBytes)
+	}
+}
+
+func TestReassembleBufferBound(t *testing.T) {
+	rec := &recordingReassembler{}
+	flow := &tcpFlow{reassemblers: []TCPReassembler{rec}}
+	ctx := &flows.EventContext{}
+
+	first := &layers.TCP{Seq: 0}
+	first.Payload = []byte("X")
+	flow.src.reassemble(flow, true, first, ctx)
+
+	chunk := make([]byte, maxReassemblyBuffered/4)
+	seq := uint32(1000)
+	for i := 0; i < 6; i++ {
+		seg := &layers.TCP{Seq: seq}
+		seg.Payload = chunk
+		flow.src.reassemble(flow, true, seg, ctx)
+		seq += uint32(len(chunk)) + 1000
+	}
+	if flow.src.bufferedBytes > maxReassemblyBuffered {
+		t.Fatalf("bufferedBytes = %d, exceeds cap %d", flow.src.bufferedBytes, maxReassemblyBuffered)
+	}
+}
@@ -3,9 +3,9 @@ package packet
 import (
 	"bytes"
 
+	"github.com/CN-TU/go-flows/flows"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"pm.cn.tuwien.ac.at/ipfix/go-flows/flows"
 )
 
 // src 4 dst 4 proto 1 src 2 dst 2
@@ -28,17 +28,256 @@ func (t fiveTuple6) SrcPort() []byte { return t[33:35] }
 func (t fiveTuple6) DstPort() []byte { return t[35:37] }
 func (t fiveTuple6) Hash() uint64    { return fnvHash(t[:]) }
 
+// fiveTuple4 plus a 4 byte tunnel discriminator (VNI, GRE key, MPLS label
+// stack hash, or VLAN id), appended so hashing a tunneled flow stays
+// allocation-free just like the untunneled keys.
+type fiveTuple4Tunnel [17]byte
+
+func (t fiveTuple4Tunnel) SrcIP() []byte   { return t[0:4] }
+func (t fiveTuple4Tunnel) DstIP() []byte   { return t[4:8] }
+func (t fiveTuple4Tunnel) Proto() byte     { return t[8] }
+func (t fiveTuple4Tunnel) SrcPort() []byte { return t[9:11] }
+func (t fiveTuple4Tunnel) DstPort() []byte { return t[11:13] }
+func (t fiveTuple4Tunnel) Tunnel() []byte  { return t[13:17] }
+func (t fiveTuple4Tunnel) Hash() uint64    { return fnvHash(t[:]) }
+
+// fiveTuple6 plus the same 4 byte tunnel discriminator.
+type fiveTuple6Tunnel [41]byte
+
+func (t fiveTuple6Tunnel) SrcIP() []byte   { return t[0:16] }
+func (t fiveTuple6Tunnel) DstIP() []byte   { return t[16:32] }
+func (t fiveTuple6Tunnel) Proto() byte     { return t[32] }
+func (t fiveTuple6Tunnel) SrcPort() []byte { return t[33:35] }
+func (t fiveTuple6Tunnel) DstPort() []byte { return t[35:37] }
+func (t fiveTuple6Tunnel) Tunnel() []byte  { return t[37:41] }
+func (t fiveTuple6Tunnel) Hash() uint64    { return fnvHash(t[:]) }
+
+// TunnelMode selects which layer(s) fivetuple keys encapsulated traffic on.
+type TunnelMode int
+
+const (
+	// TunnelModeOuter keys only on the outermost network+transport layer,
+	// so every flow inside a tunnel collapses into the tunnel endpoints.
+	// This is the historical behaviour and the default.
+	TunnelModeOuter TunnelMode = iota
+	// TunnelModeInner keys on the innermost network+transport layer,
+	// making the tunnel itself transparent.
+	TunnelModeInner
+	// TunnelModeBoth keys on the innermost network+transport layer plus
+	// the tunnel discriminator, so inner flows belonging to different
+	// tunnels are tracked separately instead of being merged.
+	TunnelModeBoth
+)
+
 var emptyPort = make([]byte, 2)
 
+// tunnelKinds are the encapsulation layers fivetuple recognizes for
+// tunnel-aware keying.
+var tunnelKinds = map[gopacket.LayerType]bool{
+	layers.LayerTypeVXLAN: true,
+	layers.LayerTypeGRE:   true,
+	layers.LayerTypeMPLS:  true,
+	layers.LayerTypeDot1Q: true,
+}
+
+// findTunnel walks packet's decoded layers looking for the first recognized
+// encapsulation (VXLAN, GRE, GTP-U, MPLS, 802.1Q/QinQ). It returns a 4 byte
+// discriminator for that tunnel (VNI, GRE key, MPLS label stack hash, or
+// outer VLAN id) plus the inner network/transport layers it carries. ok is
+// false if no supported encapsulation was found, or a supported one was
+// found but its inner traffic couldn't be resolved into a network layer.
+//
+// For VXLAN/GRE/MPLS/802.1Q, gopacket has already decoded the inner headers
+// into packet.Layers() right after the encapsulation layer, so finding them
+// is just innerLayers from the right index. GTP-U has no gopacket decoder
+// at all - decodeGTPUPayload parses it manually instead.
+func findTunnel(packet gopacket.Packet) (discriminator [4]byte, network gopacket.NetworkLayer, transport gopacket.TransportLayer, ok bool) {
+	ls := packet.Layers()
+	for i, l := range ls {
+		if !tunnelKinds[l.LayerType()] {
+			continue
+		}
+		switch v := l.(type) {
+		case *layers.VXLAN:
+			putUint32(discriminator[:], v.VNI)
+			network, transport = innerLayers(ls, i+1)
+			return discriminator, network, transport, network != nil
+		case *layers.GRE:
+			if v.KeyPresent {
+				putUint32(discriminator[:], v.Key)
+			}
+			network, transport = innerLayers(ls, i+1)
+			return discriminator, network, transport, network != nil
+		case *layers.MPLS:
+			h := fnvHash(l.LayerContents())
+			j := i
+			for j+1 < len(ls) {
+				next, isMPLS := ls[j+1].(*layers.MPLS)
+				if !isMPLS {
+					break
+				}
+				h = h*31 + fnvHash(next.LayerContents())
+				j++
+			}
+			putUint32(discriminator[:], uint32(h))
+			network, transport = innerLayers(ls, j+1)
+			return discriminator, network, transport, network != nil
+		case *layers.Dot1Q:
+			if i+1 < len(ls) {
+				if _, qinq := ls[i+1].(*layers.Dot1Q); qinq {
+					putUint16(discriminator[:2], v.VLANIdentifier)
+					network, transport = innerLayers(ls, i+2)
+					return discriminator, network, transport, network != nil
+				}
+			}
+		}
+	}
+	if gtp := findGTPU(ls); gtp != nil {
+		putUint32(discriminator[:], gtp.teid)
+		network, transport = decodeGTPUPayload(gtp.payload)
+		return discriminator, network, transport, network != nil
+	}
+	return discriminator, nil, nil, false
+}
+
+// gtpMatch is the result of a manual GTP-U v1 header scan: gopacket has no
+// built-in GTP-U decoder, so the header (flags, message type, length, TEID)
+// is parsed directly out of the UDP payload on port 2152. payload is
+// whatever the GTP-U header says follows it - the encapsulated IP datagram.
+type gtpMatch struct {
+	teid    uint32
+	payload []byte
+}
+
+// findGTPU scans ls for a UDP layer on the GTP-U port (2152) carrying a
+// GTPv1 header, and returns its TEID plus the bytes after the header -
+// including any optional sequence number/N-PDU/extension header fields
+// the header's flags say are present - which decodeGTPUPayload then
+// decodes as the encapsulated packet.
+func findGTPU(ls []gopacket.Layer) *gtpMatch {
+	for _, l := range ls {
+		udp, ok := l.(*layers.UDP)
+		if !ok || (udp.DstPort != 2152 && udp.SrcPort != 2152) {
+			continue
+		}
+		payload := udp.LayerPayload()
+		if len(payload) < 8 || payload[0]>>5 != 1 { // version field == 1
+			continue
+		}
+		flags := payload[0]
+		teid := uint32(payload[4])<<24 | uint32(payload[5])<<16 | uint32(payload[6])<<8 | uint32(payload[7])
+		hdrLen := 8
+		if flags&0x07 != 0 { // E, S or PN set: 4 extra octets are present
+			hdrLen += 4
+			if len(payload) < hdrLen {
+				continue
+			}
+			if flags&0x04 != 0 { // E: a chain of extension headers follows
+				next := payload[hdrLen-1]
+				for next != 0 && len(payload) > hdrLen {
+					extLen := int(payload[hdrLen]) * 4
+					if extLen == 0 || len(payload) < hdrLen+extLen {
+						hdrLen = len(payload)
+						break
+					}
+					next = payload[hdrLen+extLen-1]
+					hdrLen += extLen
+				}
+			}
+		}
+		if len(payload) <= hdrLen {
+			continue
+		}
+		return &gtpMatch{teid: teid, payload: payload[hdrLen:]}
+	}
+	return nil
+}
+
+// decodeGTPUPayload decodes payload - the bytes GTP-U carries after its own
+// header - as a standalone IPv4 or IPv6 packet, sniffing the version
+// nibble to pick the right gopacket decoder, since there's no outer layer
+// to have decided that for us the way there is for the other tunnel kinds.
+func decodeGTPUPayload(payload []byte) (gopacket.NetworkLayer, gopacket.TransportLayer) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	var first gopacket.LayerType
+	switch payload[0] >> 4 {
+	case 4:
+		first = layers.LayerTypeIPv4
+	case 6:
+		first = layers.LayerTypeIPv6
+	default:
+		return nil, nil
+	}
+	inner := gopacket.NewPacket(payload, first, gopacket.NoCopy)
+	return innerLayers(inner.Layers(), 0)
+}
+
+// innerLayers returns the first network and (if any) transport layer found
+// in ls starting at index start.
+func innerLayers(ls []gopacket.Layer, start int) (network gopacket.NetworkLayer, transport gopacket.TransportLayer) {
+	for _, l := range ls[start:] {
+		if network == nil {
+			if n, ok := l.(gopacket.NetworkLayer); ok {
+				network = n
+				continue
+			}
+		}
+		if network != nil && transport == nil {
+			if t, ok := l.(gopacket.TransportLayer); ok {
+				transport = t
+				break
+			}
+		}
+	}
+	return
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
+
+func putUint16(b []byte, v uint16) {
+	b[0] = byte(v >> 8)
+	b[1] = byte(v)
+}
+
+// fivetuple is the pre-tunnel-support entry point, kept around so that
+// callers outside this package - there's at least a FlowTable keying
+// option that predates TunnelMode - don't break when Fivetuple gained its
+// mode parameter. It always keys on the outermost layer, matching what
+// fivetuple did before this parameter existed.
 func fivetuple(packet gopacket.Packet) (flows.FlowKey, bool) {
+	return Fivetuple(packet, TunnelModeOuter)
+}
+
+// Fivetuple computes the flow key for packet according to mode. It is
+// exported, rather than called only from within this package, so that a
+// FlowTable option for choosing TunnelMode can pass its configured value
+// straight through without needing any other change in this package; no
+// such option exists yet, so every caller today still has to pass
+// TunnelModeOuter explicitly.
+func Fivetuple(packet gopacket.Packet, mode TunnelMode) (flows.FlowKey, bool) {
 	network := packet.NetworkLayer()
-	if network == nil {
-		return nil, false
-	}
 	transport := packet.TransportLayer()
-	if transport == nil {
+
+	var tunnel [4]byte
+	var haveTunnel bool
+	if mode != TunnelModeOuter {
+		if disc, inNet, inTransport, ok := findTunnel(packet); ok {
+			network, transport = inNet, inTransport
+			tunnel, haveTunnel = disc, true
+		}
+	}
+
+	if network == nil || transport == nil {
 		return nil, false
 	}
+
 	srcPort, dstPort := transport.TransportFlow().Endpoints()
 	srcPortR := srcPort.Raw()
 	dstPortR := dstPort.Raw()
@@ -75,6 +314,16 @@ func fivetuple(packet gopacket.Packet) (flows.FlowKey, bool) {
 	dstIPR := dstIP.Raw()
 
 	if len(srcIPR) == 4 {
+		if haveTunnel && mode == TunnelModeBoth {
+			ret := fiveTuple4Tunnel{}
+			copy(ret[0:4], srcIPR)
+			copy(ret[4:8], dstIPR)
+			ret[8] = protoB
+			copy(ret[9:11], srcPortR)
+			copy(ret[11:13], dstPortR)
+			copy(ret[13:17], tunnel[:])
+			return ret, forward
+		}
 		ret := fiveTuple4{}
 		copy(ret[0:4], srcIPR)
 		copy(ret[4:8], dstIPR)
@@ -84,6 +333,16 @@ func fivetuple(packet gopacket.Packet) (flows.FlowKey, bool) {
 		return ret, forward
 	}
 	if len(srcIPR) == 16 {
+		if haveTunnel && mode == TunnelModeBoth {
+			ret := fiveTuple6Tunnel{}
+			copy(ret[0:16], srcIPR)
+			copy(ret[16:32], dstIPR)
+			ret[32] = protoB
+			copy(ret[33:35], srcPortR)
+			copy(ret[35:37], dstPortR)
+			copy(ret[37:41], tunnel[:])
+			return ret, forward
+		}
 		ret := fiveTuple6{}
 		copy(ret[0:16], srcIPR)
 		copy(ret[16:32], dstIPR)
@@ -93,4 +352,4 @@ func fivetuple(packet gopacket.Packet) (flows.FlowKey, bool) {
 		return ret, forward
 	}
 	return nil, false
-}
\ No newline at end of file
+}
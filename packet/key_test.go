@@ -0,0 +1,352 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildInnerTCPPacket returns the serialized bytes of a bare IPv4/TCP
+// segment, used as the encapsulated payload for the tunnel builders below.
+func buildInnerTCPPacket(t *testing.T) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	innerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	innerTCP := &layers.TCP{SrcPort: 1234, DstPort: 443, SYN: true, Seq: 1}
+	if err := innerTCP.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, innerIP, innerTCP); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatalf("ParseMAC(%q): %v", s, err)
+	}
+	return mac
+}
+
+// buildVXLANPacket returns a raw Ethernet frame carrying a VXLAN-encapsulated
+// TCP segment: outer Ethernet/IPv4/UDP/VXLAN, inner Ethernet/IPv4/TCP.
+func buildVXLANPacket(t *testing.T) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+
+	innerEth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:01"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:02"),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	innerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	innerTCP := &layers.TCP{SrcPort: 1234, DstPort: 443, SYN: true, Seq: 1}
+	if err := innerTCP.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+	innerBuf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(innerBuf, opts, innerEth, innerIP, innerTCP); err != nil {
+		t.Fatal(err)
+	}
+
+	outerEth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:03"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:04"),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 1, 1),
+		DstIP:    net.IPv4(192, 168, 1, 2),
+	}
+	outerUDP := &layers.UDP{SrcPort: 5000, DstPort: 4789}
+	if err := outerUDP.SetNetworkLayerForChecksum(outerIP); err != nil {
+		t.Fatal(err)
+	}
+	vxlan := &layers.VXLAN{ValidIDFlag: true, VNI: 42}
+
+	outerBuf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(outerBuf, opts, outerEth, outerIP, outerUDP, vxlan, gopacket.Payload(innerBuf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), outerBuf.Bytes()...)
+}
+
+func TestFindTunnelVXLAN(t *testing.T) {
+	raw := buildVXLANPacket(t)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	disc, network, transport, ok := findTunnel(pkt)
+	if !ok {
+		t.Fatal("findTunnel did not detect the VXLAN encapsulation")
+	}
+	want := [4]byte{0, 0, 0, 42}
+	if disc != want {
+		t.Fatalf("discriminator = %v, want %v (VNI 42)", disc, want)
+	}
+	if network == nil || transport == nil {
+		t.Fatal("findTunnel did not find the inner IPv4/TCP headers")
+	}
+	if transport.LayerType() != layers.LayerTypeTCP {
+		t.Fatalf("inner transport = %v, want TCP", transport.LayerType())
+	}
+}
+
+// buildGREPacket returns a raw Ethernet frame carrying a GRE-encapsulated
+// TCP segment: outer Ethernet/IPv4/GRE, inner IPv4/TCP directly (GRE's own
+// Protocol field plays the role the outer Ethertype/Dot1Q.Type plays for
+// the other tunnel kinds).
+func buildGREPacket(t *testing.T) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	inner := buildInnerTCPPacket(t)
+
+	outerEth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:03"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:04"),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolGRE,
+		SrcIP:    net.IPv4(192, 168, 1, 1),
+		DstIP:    net.IPv4(192, 168, 1, 2),
+	}
+	gre := &layers.GRE{Protocol: layers.EthernetTypeIPv4, KeyPresent: true, Key: 99}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, outerEth, outerIP, gre, gopacket.Payload(inner)); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestFindTunnelGRE(t *testing.T) {
+	raw := buildGREPacket(t)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	disc, network, transport, ok := findTunnel(pkt)
+	if !ok {
+		t.Fatal("findTunnel did not detect the GRE encapsulation")
+	}
+	want := [4]byte{0, 0, 0, 99}
+	if disc != want {
+		t.Fatalf("discriminator = %v, want %v (GRE key 99)", disc, want)
+	}
+	if network == nil || transport == nil || transport.LayerType() != layers.LayerTypeTCP {
+		t.Fatalf("findTunnel did not find the inner IPv4/TCP headers (transport=%v)", transport)
+	}
+}
+
+// buildQinQPacket returns a raw Ethernet frame carrying an 802.1Q QinQ
+// encapsulated TCP segment: outer VLAN tag, inner VLAN tag, then IPv4/TCP.
+func buildQinQPacket(t *testing.T) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:03"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:04"),
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	outerTag := &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeDot1Q}
+	innerTag := &layers.Dot1Q{VLANIdentifier: 20, Type: layers.EthernetTypeIPv4}
+	innerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	innerTCP := &layers.TCP{SrcPort: 1234, DstPort: 443, SYN: true, Seq: 1}
+	if err := innerTCP.SetNetworkLayerForChecksum(innerIP); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, eth, outerTag, innerTag, innerIP, innerTCP); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestFindTunnelQinQ(t *testing.T) {
+	raw := buildQinQPacket(t)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	disc, network, transport, ok := findTunnel(pkt)
+	if !ok {
+		t.Fatal("findTunnel did not detect the QinQ encapsulation")
+	}
+	want := [4]byte{0, 10, 0, 0}
+	if disc != want {
+		t.Fatalf("discriminator = %v, want %v (outer VLAN 10)", disc, want)
+	}
+	if network == nil || transport == nil || transport.LayerType() != layers.LayerTypeTCP {
+		t.Fatalf("findTunnel did not find the inner IPv4/TCP headers (transport=%v)", transport)
+	}
+}
+
+// buildMPLSPacket returns a raw Ethernet frame carrying an MPLS-labelled
+// TCP segment: outer Ethernet (Ethertype MPLS unicast), a single-entry
+// label stack, then a bare IPv4/TCP datagram. gopacket's MPLS decoder has
+// no notion of what follows a label stack other than sniffing the IP
+// version nibble once StackBottom is set, so - unlike GRE/Dot1Q - there's
+// no SerializableLayer for it; the label stack entry is built by hand.
+func buildMPLSPacket(t *testing.T) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	inner := buildInnerTCPPacket(t)
+
+	const label, ttl = 100, 64
+	entry := make([]byte, 4)
+	binary.BigEndian.PutUint32(entry, uint32(label)<<12|1<<8|uint32(ttl)) // S=1 (bottom of stack)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:03"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:04"),
+		EthernetType: layers.EthernetTypeMPLSUnicast,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, eth, gopacket.Payload(append(entry, inner...))); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestFindTunnelMPLS(t *testing.T) {
+	raw := buildMPLSPacket(t)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	_, network, transport, ok := findTunnel(pkt)
+	if !ok {
+		t.Fatal("findTunnel did not detect the MPLS encapsulation")
+	}
+	if network == nil || transport == nil || transport.LayerType() != layers.LayerTypeTCP {
+		t.Fatalf("findTunnel did not find the inner IPv4/TCP headers (transport=%v)", transport)
+	}
+}
+
+// buildGTPUPacket returns a raw Ethernet frame carrying a GTP-U encapsulated
+// TCP segment: outer Ethernet/IPv4/UDP (port 2152), a minimal GTPv1-U
+// header (no optional fields), then a bare IPv4/TCP datagram. gopacket has
+// no GTP-U decoder, so the header is built by hand the same way
+// findGTPU parses it back out.
+func buildGTPUPacket(t *testing.T, teid uint32) []byte {
+	t.Helper()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	inner := buildInnerTCPPacket(t)
+
+	gtpHeader := make([]byte, 8)
+	gtpHeader[0] = 0x30 // version 1, PT=1, no E/S/PN
+	gtpHeader[1] = 0xff // G-PDU
+	binary.BigEndian.PutUint16(gtpHeader[2:4], uint16(len(inner)))
+	binary.BigEndian.PutUint32(gtpHeader[4:8], teid)
+
+	outerEth := &layers.Ethernet{
+		SrcMAC:       mustMAC(t, "00:00:00:00:00:03"),
+		DstMAC:       mustMAC(t, "00:00:00:00:00:04"),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	outerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 168, 1, 1),
+		DstIP:    net.IPv4(192, 168, 1, 2),
+	}
+	outerUDP := &layers.UDP{SrcPort: 2152, DstPort: 2152}
+	if err := outerUDP.SetNetworkLayerForChecksum(outerIP); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, outerEth, outerIP, outerUDP, gopacket.Payload(append(gtpHeader, inner...))); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestFindTunnelGTPU(t *testing.T) {
+	raw := buildGTPUPacket(t, 0xcafe)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	disc, network, transport, ok := findTunnel(pkt)
+	if !ok {
+		t.Fatal("findTunnel did not detect the GTP-U encapsulation")
+	}
+	want := [4]byte{0, 0, 0xca, 0xfe}
+	if disc != want {
+		t.Fatalf("discriminator = %v, want %v (TEID 0xcafe)", disc, want)
+	}
+	if network == nil || transport == nil {
+		t.Fatal("findTunnel did not decode the GTP-U payload into inner IPv4/TCP headers")
+	}
+	if transport.LayerType() != layers.LayerTypeTCP {
+		t.Fatalf("inner transport = %v, want TCP", transport.LayerType())
+	}
+	if !net.IP(network.NetworkFlow().Src().Raw()).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("inner network src = %v, want the encapsulated endpoint", network.NetworkFlow().Src())
+	}
+}
+
+func TestFivetupleTunnelModes(t *testing.T) {
+	raw := buildVXLANPacket(t)
+	pkt := gopacket.NewPacket(raw, layers.LayerTypeEthernet, gopacket.Default)
+
+	outerKey, _ := Fivetuple(pkt, TunnelModeOuter)
+	outer, ok := outerKey.(fiveTuple4)
+	if !ok {
+		t.Fatalf("TunnelModeOuter key type = %T, want fiveTuple4", outerKey)
+	}
+	if !net.IP(outer.SrcIP()).Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Fatalf("outer SrcIP = %v, want the outer tunnel endpoint", net.IP(outer.SrcIP()))
+	}
+
+	innerKey, _ := Fivetuple(pkt, TunnelModeInner)
+	inner, ok := innerKey.(fiveTuple4)
+	if !ok {
+		t.Fatalf("TunnelModeInner key type = %T, want fiveTuple4", innerKey)
+	}
+	if !net.IP(inner.SrcIP()).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("inner SrcIP = %v, want the encapsulated endpoint", net.IP(inner.SrcIP()))
+	}
+	if inner.Proto() != byte(layers.IPProtocolTCP) {
+		t.Fatalf("inner Proto = %v, want TCP", inner.Proto())
+	}
+
+	bothKey, _ := Fivetuple(pkt, TunnelModeBoth)
+	both, ok := bothKey.(fiveTuple4Tunnel)
+	if !ok {
+		t.Fatalf("TunnelModeBoth key type = %T, want fiveTuple4Tunnel", bothKey)
+	}
+	if !net.IP(both.SrcIP()).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("both SrcIP = %v, want the encapsulated endpoint", net.IP(both.SrcIP()))
+	}
+	wantTunnel := []byte{0, 0, 0, 42}
+	if string(both.Tunnel()) != string(wantTunnel) {
+		t.Fatalf("both Tunnel = %v, want %v", both.Tunnel(), wantTunnel)
+	}
+}
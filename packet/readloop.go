@@ -0,0 +1,48 @@
+package packet
+
+import (
+	"github.com/CN-TU/go-flows/flows"
+	"github.com/google/gopacket"
+)
+
+// fdSource is implemented by packet sources that expose the raw file
+// descriptor of the socket they read from (e.g. an AF_PACKET SOCK_DGRAM
+// capture socket). newBatchSource type-asserts for it on Linux to decide
+// whether the recvmmsg(2) batch path is available; sources that don't
+// implement it - and every source on non-Linux builds, since there is no
+// recvmmsg(2) there - go through fillOnePacketAtATime instead. Keeping
+// this check behind an interface, rather than a GOOS branch at the call
+// site, is what lets newBatchSource keep one signature across platforms.
+type fdSource interface {
+	Fd() int
+}
+
+// fillOnePacketAtATime reads up to len(buffer.buffers) packets, one
+// ReadPacketData call at a time, copying each into the corresponding
+// packetBuffer.buffer. It's the portable fallback used whenever a batch
+// read isn't available: always on non-Linux builds, and on Linux for any
+// source that doesn't implement fdSource. It stops early (without error)
+// once src runs out of packets.
+func fillOnePacketAtATime(src gopacket.PacketDataSource, buffer *shallowMultiPacketBuffer) (int, error) {
+	n := len(buffer.buffers)
+	var i int
+	for ; i < n; i++ {
+		data, ci, err := src.ReadPacketData()
+		if err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			break
+		}
+		pb := buffer.buffers[i]
+		if cap(pb.buffer) < len(data) {
+			pb.buffer = make([]byte, len(data))
+		}
+		pb.buffer = pb.buffer[:len(data)]
+		copy(pb.buffer, data)
+		buffer.setTimestamp(flows.DateTimeNanoseconds(ci.Timestamp.UnixNano()))
+	}
+	buffer.windex = i
+	buffer.rindex = 0
+	return i, nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package packet
+
+import (
+	"github.com/google/gopacket"
+)
+
+// batchSource is the non-Linux fallback: it has no recvmmsg(2) equivalent
+// available, so it always fills a shallowMultiPacketBuffer through
+// fillOnePacketAtATime, reading one packet at a time from the underlying
+// gopacket.PacketDataSource.
+//
+// As with the Linux batchSource, the caller must populate buffer with real
+// *packetBuffers (normally via multiPacketBuffer.Pop) before calling fill;
+// that capture-setup wiring lives outside this package.
+type batchSource struct {
+	src gopacket.PacketDataSource
+}
+
+// newBatchSource wraps src for batched reads. filters is accepted for
+// signature parity with the Linux constructor but is otherwise unused
+// here: attaching a filter to the kernel capture path (see AttachFilters)
+// needs the socket's file descriptor, which isn't available portably
+// without one.
+func newBatchSource(src gopacket.PacketDataSource, filters Filters) (*batchSource, error) {
+	return &batchSource{src: src}, nil
+}
+
+// fill reads up to len(buffer.buffers) packets, one ReadPacketData call at
+// a time, copying each packet into the corresponding packetBuffer.buffer.
+// It stops early (without error) once the source runs out of packets.
+func (s *batchSource) fill(buffer *shallowMultiPacketBuffer) (int, error) {
+	return fillOnePacketAtATime(s.src, buffer)
+}
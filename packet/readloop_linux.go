@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+package packet
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/CN-TU/go-flows/flows"
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+// batchSource reads batches of raw packets from a socket using recvmmsg(2),
+// avoiding a syscall per packet at high packet rates. It fills the
+// preallocated packetBuffer.buffer slices of a shallowMultiPacketBuffer
+// directly, so no extra copy is needed beyond what multiPacketBuffer
+// already does.
+//
+// Not every gopacket.PacketDataSource exposes a file descriptor to drive
+// recvmmsg(2) with, so a batchSource built from one of those falls back to
+// fillOnePacketAtATime via src, the same path readloop_generic.go uses
+// unconditionally.
+//
+// The caller is responsible for populating buffer with real *packetBuffers
+// before calling fill - normally via multiPacketBuffer.Pop, exactly the
+// way the capture-setup code that constructs a batchSource already has to
+// obtain a shallowMultiPacketBuffer in the first place. That capture setup
+// (binding/selecting the AF_PACKET socket, deciding batch sizing, wiring
+// the result into a FlowTable) lives outside this package and isn't part
+// of this change.
+type batchSource struct {
+	fd     int
+	fdMode bool
+	src    gopacket.PacketDataSource
+	msgs   []unix.Mmsghdr
+	iovecs []unix.Iovec
+	oob    [][]byte
+}
+
+// newBatchSource wraps src for batched reads. If src implements fdSource -
+// exposing an already bound/connected datagram-oriented socket fd, e.g.
+// AF_PACKET SOCK_DGRAM - it enables SO_TIMESTAMPNS on that fd so every
+// received packet carries a kernel timestamp, and attaches any filter in
+// filters that supports kernel-side attachment (see AttachFilters) so the
+// kernel can start dropping non-matching packets before recvmmsg ever
+// copies them into userspace. Otherwise it falls back to reading src one
+// packet at a time, same as the non-Linux implementation.
+func newBatchSource(src gopacket.PacketDataSource, filters Filters) (*batchSource, error) {
+	fs, ok := src.(fdSource)
+	if !ok {
+		return &batchSource{src: src}, nil
+	}
+	fd := fs.Fd()
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		return nil, err
+	}
+	AttachFilters(filters, fd)
+	return &batchSource{fd: fd, fdMode: true}, nil
+}
+
+// grow (re)allocates the per-message scratch space for a batch of n packets.
+func (s *batchSource) grow(n int) {
+	if len(s.msgs) >= n {
+		return
+	}
+	s.msgs = make([]unix.Mmsghdr, n)
+	s.iovecs = make([]unix.Iovec, n)
+	s.oob = make([][]byte, n)
+	for i := range s.oob {
+		s.oob[i] = make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))
+	}
+}
+
+// fill reads up to len(buffer.buffers) packets in a single recvmmsg(2) call,
+// landing the payload of every packet directly in the corresponding
+// packetBuffer.buffer and recording the last received SO_TIMESTAMPNS
+// timestamp on buffer itself. It returns the number of packets read.
+func (s *batchSource) fill(buffer *shallowMultiPacketBuffer) (int, error) {
+	if !s.fdMode {
+		return fillOnePacketAtATime(s.src, buffer)
+	}
+	n := len(buffer.buffers)
+	s.grow(n)
+	msgs := s.msgs[:n]
+	for i := 0; i < n; i++ {
+		pb := buffer.buffers[i]
+		s.iovecs[i] = unix.Iovec{Base: &pb.buffer[:cap(pb.buffer)][0]}
+		s.iovecs[i].SetLen(cap(pb.buffer))
+		msgs[i] = unix.Mmsghdr{}
+		msgs[i].Hdr.SetIovlen(1)
+		msgs[i].Hdr.Iov = &s.iovecs[i]
+		msgs[i].Hdr.Control = &s.oob[i][0]
+		msgs[i].Hdr.SetControllen(len(s.oob[i]))
+	}
+
+	got, err := unix.Recvmmsg(s.fd, msgs, unix.MSG_WAITFORONE, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var last time.Time
+	valid := 0
+	for i := 0; i < got; i++ {
+		pb := buffer.buffers[i]
+		n := int(msgs[i].Len)
+		if msgs[i].Hdr.Flags&unix.MSG_TRUNC != 0 {
+			// The packet didn't fit pb's preallocated buffer and the
+			// kernel discarded the rest; there's nothing left to recover
+			// for this one, so grow the slot for subsequent reads (like
+			// packetBuffer.resize would) and drop it instead of handing
+			// decoders a truncated frame. Dropping it here means it never
+			// reaches buffer.buffers[:valid], so it has to be recycled
+			// back to its pool by hand - the same way recycle() does for
+			// buffers it does see - or it leaks out of circulation for
+			// good.
+			if n > cap(pb.buffer) {
+				pb.buffer = make([]byte, n)
+			}
+			if pb.canRecycle() {
+				atomic.StoreInt32(&pb.inUse, 0)
+				pb.owner.free(1)
+			}
+			continue
+		}
+		pb.buffer = pb.buffer[:cap(pb.buffer)][:n]
+		buffer.buffers[valid] = pb
+		valid++
+		if ts, ok := parseTimestampNS(s.oob[i][:msgs[i].Hdr.Controllen]); ok {
+			last = ts
+		}
+	}
+	if !last.IsZero() {
+		buffer.setTimestamp(flows.DateTimeNanoseconds(last.UnixNano()))
+	}
+	buffer.windex = valid
+	buffer.rindex = 0
+
+	return valid, nil
+}
+
+// parseTimestampNS extracts a SO_TIMESTAMPNS control message from oob.
+func parseTimestampNS(oob []byte) (time.Time, bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, m := range messages {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_TIMESTAMPNS {
+			ts := *(*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Sec, ts.Nsec), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package packet
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+// noFdSource is a gopacket.PacketDataSource that does not implement
+// fdSource, to exercise newBatchSource's fallback to the per-packet path.
+type noFdSource struct{}
+
+func (noFdSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, errors.New("no packets")
+}
+
+func TestBatchSourceGrow(t *testing.T) {
+	s := &batchSource{}
+	s.grow(4)
+	if len(s.msgs) != 4 || len(s.iovecs) != 4 || len(s.oob) != 4 {
+		t.Fatalf("grow(4) left msgs=%d iovecs=%d oob=%d, want 4 each", len(s.msgs), len(s.iovecs), len(s.oob))
+	}
+	// growing to a smaller batch must not shrink the scratch space
+	s.grow(2)
+	if len(s.msgs) != 4 {
+		t.Fatalf("grow(2) after grow(4) shrunk msgs to %d", len(s.msgs))
+	}
+}
+
+func TestParseTimestampNS(t *testing.T) {
+	want := unix.Timespec{Sec: 1234, Nsec: 5678}
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(want))))
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = unix.SOL_SOCKET
+	hdr.Type = unix.SO_TIMESTAMPNS
+	hdr.SetLen(unix.CmsgLen(int(unsafe.Sizeof(want))))
+	*(*unix.Timespec)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = want
+
+	got, ok := parseTimestampNS(oob)
+	if !ok {
+		t.Fatal("parseTimestampNS did not find the SO_TIMESTAMPNS message")
+	}
+	wantTime := time.Unix(want.Sec, want.Nsec)
+	if !got.Equal(wantTime) {
+		t.Fatalf("parseTimestampNS = %v, want %v", got, wantTime)
+	}
+}
+
+// TestBatchSourceFillRecyclesTruncated verifies that a packet the kernel
+// reports as MSG_TRUNC is handed back to its multiPacketBuffer instead of
+// just being excluded from buffer.buffers[:valid], which would otherwise
+// permanently remove that slot from the pool's free list.
+func TestBatchSourceFillRecyclesTruncated(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	mpb := newMultiPacketBuffer(1, 8, false)
+	mpb.replenish()
+	smpb := newShallowMultiPacketBuffer(1, nil)
+	mpb.Pop(smpb, func(int, int) {}, func(int, int) {})
+	smpb.windex = len(smpb.buffers)
+	pb := smpb.buffers[0]
+	freeAfterPop := atomic.LoadInt32(&mpb.numFree)
+
+	if _, err := unix.Write(fds[1], make([]byte, 64)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	s := &batchSource{fd: fds[0], fdMode: true}
+	valid, err := s.fill(smpb)
+	if err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if valid != 0 {
+		t.Fatalf("fill reported %d valid packets, want 0 for a truncated one", valid)
+	}
+	if atomic.LoadInt32(&pb.inUse) != 0 {
+		t.Fatal("fill left the truncated packetBuffer marked in use")
+	}
+	if got := atomic.LoadInt32(&mpb.numFree); got != freeAfterPop+1 {
+		t.Fatalf("mpb.numFree = %d after fill, want %d (truncated buffer returned to the pool)", got, freeAfterPop+1)
+	}
+}
+
+// TestBatchSourceFillReadsPacket is the happy-path companion to
+// TestBatchSourceFillRecyclesTruncated: it drives s.fill through an actual
+// unix.Recvmmsg call on a real socket pair and checks that a normal,
+// untruncated packet comes back with the right payload and timestamp,
+// rather than only ever exercising the truncated/zero-valid branch.
+func TestBatchSourceFillReadsPacket(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	if err := unix.SetsockoptInt(fds[0], unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		t.Fatalf("setsockopt SO_TIMESTAMPNS: %v", err)
+	}
+
+	mpb := newMultiPacketBuffer(1, 64, false)
+	mpb.replenish()
+	smpb := newShallowMultiPacketBuffer(1, nil)
+	mpb.Pop(smpb, func(int, int) {}, func(int, int) {})
+	smpb.windex = len(smpb.buffers)
+
+	payload := []byte("hello, recvmmsg")
+	if _, err := unix.Write(fds[1], payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	s := &batchSource{fd: fds[0], fdMode: true}
+	valid, err := s.fill(smpb)
+	if err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if valid != 1 {
+		t.Fatalf("fill reported %d valid packets, want 1", valid)
+	}
+	pb := smpb.buffers[0]
+	if string(pb.buffer) != string(payload) {
+		t.Fatalf("fill read %q, want %q", pb.buffer, payload)
+	}
+	if smpb.Timestamp() == 0 {
+		t.Fatal("fill left buffer's timestamp unset despite SO_TIMESTAMPNS")
+	}
+}
+
+// TestNewBatchSourceFallsBackWithoutFd checks that a source which doesn't
+// implement fdSource - and so can't drive recvmmsg(2) - still produces a
+// usable batchSource rather than requiring callers to special-case it per
+// platform.
+func TestNewBatchSourceFallsBackWithoutFd(t *testing.T) {
+	s, err := newBatchSource(noFdSource{}, nil)
+	if err != nil {
+		t.Fatalf("newBatchSource: %v", err)
+	}
+	if s.fdMode {
+		t.Fatal("newBatchSource reported fdMode for a source without Fd()")
+	}
+}
+
+func TestParseTimestampNSMissing(t *testing.T) {
+	if _, ok := parseTimestampNS(nil); ok {
+		t.Fatal("parseTimestampNS found a timestamp in an empty control message")
+	}
+}